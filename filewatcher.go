@@ -0,0 +1,275 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// Op describes the kind of change a FileWatcher observed. It mirrors
+// fsnotify's Op so both backends can report the same event shape.
+type Op uint32
+
+// Event operations, matching fsnotify's semantics.
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+// Event is a single filesystem change reported by a FileWatcher.
+type Event struct {
+	Name string
+	Op   Op
+}
+
+// FileWatcher watches a set of paths for changes and reports them as
+// Events. It's implemented both by an fsnotify-backed watcher and by a
+// pure polling watcher, so callers can fall back to polling on platforms
+// or filesystems where inotify is unavailable or unreliable.
+type FileWatcher interface {
+	// Events returns the channel on which change events are delivered.
+	Events() <-chan Event
+	// Errors returns the channel on which watch errors are delivered.
+	Errors() <-chan error
+	// Add starts watching the given file or directory.
+	Add(name string) error
+	// Remove stops watching the given file or directory.
+	Remove(name string) error
+	// Close releases any resources held by the watcher.
+	Close() error
+}
+
+// NewFileWatcher returns a FileWatcher backed by fsnotify, falling back to
+// a poll-based implementation if fsnotify can't be initialized (e.g. on
+// unsupported platforms, or if the inotify instance limit is reached).
+// Errors from later Add calls do not trigger the fallback.
+func NewFileWatcher() FileWatcher {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Printf("unable to create fsnotify watcher, falling back to polling: %s", err)
+		return newPollWatcher(1 * time.Second)
+	}
+
+	return newFsnotifyWatcher(watcher)
+}
+
+// fsnotifyWatcher adapts fsnotify.Watcher to the FileWatcher interface.
+type fsnotifyWatcher struct {
+	watcher *fsnotify.Watcher
+	events  chan Event
+	errors  chan error
+}
+
+func newFsnotifyWatcher(watcher *fsnotify.Watcher) *fsnotifyWatcher {
+	w := &fsnotifyWatcher{
+		watcher: watcher,
+		events:  make(chan Event),
+		errors:  make(chan error),
+	}
+
+	go w.translate()
+	return w
+}
+
+func (w *fsnotifyWatcher) Events() <-chan Event { return w.events }
+func (w *fsnotifyWatcher) Errors() <-chan error { return w.errors }
+
+func (w *fsnotifyWatcher) translate() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.events <- Event{Name: event.Name, Op: translateOp(event.Op)}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.errors <- err
+		}
+	}
+}
+
+func translateOp(op fsnotify.Op) Op {
+	var out Op
+	if op&fsnotify.Create == fsnotify.Create {
+		out |= Create
+	}
+	if op&fsnotify.Write == fsnotify.Write {
+		out |= Write
+	}
+	if op&fsnotify.Remove == fsnotify.Remove {
+		out |= Remove
+	}
+	if op&fsnotify.Rename == fsnotify.Rename {
+		out |= Rename
+	}
+	if op&fsnotify.Chmod == fsnotify.Chmod {
+		out |= Chmod
+	}
+	return out
+}
+
+func (w *fsnotifyWatcher) Add(name string) error    { return w.watcher.Add(name) }
+func (w *fsnotifyWatcher) Remove(name string) error { return w.watcher.Remove(name) }
+func (w *fsnotifyWatcher) Close() error             { return w.watcher.Close() }
+
+// pollWatcher implements FileWatcher by periodically expanding the
+// watched paths (which may be plain files, directories, or glob
+// patterns -- see expandFiles) and hashing the result on a ticker,
+// synthesizing events from the diff. Used as a fallback when fsnotify
+// isn't available.
+type pollWatcher struct {
+	duration time.Duration
+	events   chan Event
+	errors   chan error
+	done     chan bool
+
+	mu     sync.Mutex
+	names  map[string]bool
+	hashes map[string][32]byte
+}
+
+func newPollWatcher(duration time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		duration: duration,
+		names:    make(map[string]bool),
+		hashes:   make(map[string][32]byte),
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan bool),
+	}
+
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) Events() <-chan Event { return w.events }
+func (w *pollWatcher) Errors() <-chan error { return w.errors }
+
+func (w *pollWatcher) Add(name string) error {
+	// Expand and hash outside the lock: this may do directory/glob I/O
+	// across many files, and we don't want to hold w.mu (and block a
+	// concurrent poll()) for the duration.
+	seed := make(map[string][32]byte)
+	for _, file := range expandFiles([]string{name}) {
+		if hash, err := hashFile(file); err == nil {
+			seed[file] = hash
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.names[name] = true
+
+	// Seed the baseline for whatever name expands to (a single file, or
+	// every file currently in a directory/glob) so the first tick after
+	// Add doesn't report every pre-existing file as newly Created.
+	for file, hash := range seed {
+		w.hashes[file] = hash
+	}
+
+	return nil
+}
+
+func (w *pollWatcher) Remove(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.names, name)
+
+	// Drop the baseline for whatever name currently expands to, so a
+	// later poll() doesn't see the now-untracked entries as missing and
+	// synthesize spurious Remove events for files that were only
+	// unwatched, not deleted.
+	for _, file := range expandFiles([]string{name}) {
+		delete(w.hashes, file)
+	}
+
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+func (w *pollWatcher) poll() {
+	w.mu.Lock()
+	names := make([]string, 0, len(w.names))
+	for name := range w.names {
+		names = append(names, name)
+	}
+	w.mu.Unlock()
+
+	current := make(map[string][32]byte)
+	for _, file := range expandFiles(names) {
+		hash, err := hashFile(file)
+		if err != nil {
+			w.errors <- err
+			continue
+		}
+		current[file] = hash
+	}
+
+	var events []Event
+
+	w.mu.Lock()
+	for file, hash := range current {
+		old, ok := w.hashes[file]
+		switch {
+		case !ok:
+			events = append(events, Event{Name: file, Op: Create})
+		case old != hash:
+			events = append(events, Event{Name: file, Op: Write})
+		}
+		w.hashes[file] = hash
+	}
+	for file := range w.hashes {
+		if _, ok := current[file]; !ok {
+			delete(w.hashes, file)
+			events = append(events, Event{Name: file, Op: Remove})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, event := range events {
+		w.events <- event
+	}
+}
@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// Validator is run against the watched file set before a reload is
+// signalled. If it returns an error, the reload is suppressed and the
+// old file hashes are kept, so a subsequent fix to the files is still
+// detected as a change.
+type Validator func(files []string) error
+
+// ValidationError carries a short, low-cardinality Reason alongside the
+// underlying error, so callers (e.g. the ghostunnel_reload_failures_total
+// metric) have something bounded to label failures with instead of the
+// free-form error text.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// DefaultTLSValidator returns a Validator that checks certFile/keyFile
+// parse as a valid key pair and that the leaf certificate hasn't expired,
+// so a partial write or a broken cert swapped in by automation doesn't
+// take the proxy offline on the next reload.
+func DefaultTLSValidator(certFile, keyFile string) Validator {
+	return func(files []string) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return &ValidationError{Reason: "key_pair_load_failed", Err: fmt.Errorf("unable to load cert/key pair: %s", err)}
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return &ValidationError{Reason: "certificate_parse_failed", Err: fmt.Errorf("unable to parse certificate: %s", err)}
+		}
+
+		if time.Now().After(leaf.NotAfter) {
+			return &ValidationError{Reason: "certificate_expired", Err: fmt.Errorf("certificate expired at %s", leaf.NotAfter)}
+		}
+
+		return nil
+	}
+}
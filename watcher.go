@@ -17,89 +17,264 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"time"
 
-	"gopkg.in/fsnotify.v1"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// Watch files using inotify/fswatch.
-func watchAuto(files []string, notify chan bool) {
-	hashes := hashFiles(files)
-	watcher, err := fsnotify.NewWatcher()
-	panicOnError(err)
+var reloadFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ghostunnel_reload_failures_total",
+		Help: "Number of reloads suppressed because the new file set failed validation.",
+	},
+	[]string{"reason"},
+)
 
-	for _, file := range files {
-		// Need to watch both directory and file, because we want to detect
-		// files being overwritten (gives Write event) but also files being
-		// removed/re-added.
-		watcher.Add(file)
-		watcher.Add(path.Dir(file))
+func init() {
+	prometheus.MustRegister(reloadFailuresTotal)
+}
+
+// Watcher watches a set of files, directories, or glob patterns for
+// changes and signals Notify when they change. Validator, if set, is run
+// against the new file set before signalling; a failing Validator
+// suppresses the reload and keeps the old hashes, so the same broken
+// file set is re-validated (and keeps counting against
+// ghostunnel_reload_failures_total) on every subsequent check until it's
+// fixed.
+type Watcher struct {
+	Files     []string
+	Notify    chan bool
+	Validator Validator
+
+	hashes map[string][32]byte
+}
+
+// NewWatcher creates a Watcher over the given files, directories, or glob
+// patterns. notify is the channel reloads are signalled on; validator may
+// be nil to skip validation.
+func NewWatcher(files []string, notify chan bool, validator Validator) *Watcher {
+	return &Watcher{
+		Files:     files,
+		Notify:    notify,
+		Validator: validator,
+		hashes:    hashFiles(expandFiles(files)),
+	}
+}
+
+// maybeReload re-expands and re-hashes the watched files; if anything
+// changed and validation (if any) passes, it commits the new hashes and
+// signals a reload. On validation failure, the old hashes are kept, so
+// the broken file set keeps comparing as "changed" and gets re-validated
+// on every subsequent check until it's fixed.
+func (w *Watcher) maybeReload(reason string) {
+	current := expandFiles(w.Files)
+	hashes := hashFiles(current)
+
+	if !hashesDiffer(w.hashes, hashes) {
+		logger.Printf("no change (%s), not reloading", reason)
+		return
+	}
+
+	if w.Validator != nil {
+		if err := w.Validator(current); err != nil {
+			logger.Printf("reload validation failed, not reloading: %s", err)
+			reloadFailuresTotal.WithLabelValues(validationReason(err)).Inc()
+			return
+		}
+	}
+
+	logger.Printf("detected change (%s), reloading", reason)
+	w.hashes = hashes
+	w.Notify <- true
+}
+
+// validationReason extracts the low-cardinality failure category from a
+// Validator error for use as the ghostunnel_reload_failures_total
+// "reason" label, falling back to "unknown" for validators that don't
+// return a *ValidationError.
+func validationReason(err error) string {
+	if verr, ok := err.(*ValidationError); ok && verr.Reason != "" {
+		return verr.Reason
+	}
+	return "unknown"
+}
+
+// WatchAuto watches files using inotify/fswatch, falling back to polling
+// if an fsnotify watcher can't be created (see NewFileWatcher). Events within
+// debounce of each other are coalesced into a single reload, so that
+// atomic-replace patterns (Kubernetes secret projections, cert-manager,
+// rename(2) from a tempfile) that fire a burst of events only trigger one
+// reload.
+func (w *Watcher) WatchAuto(debounce time.Duration) {
+	watcher := NewFileWatcher()
+	defer watcher.Close()
+
+	for _, root := range watchRoots(w.Files) {
+		// Watch the containing directory (not just the file/glob target)
+		// so that we see the file being overwritten, removed, or
+		// re-created, and so that a freshly-appearing file matching a
+		// glob is picked up.
+		watcher.Add(root)
 	}
 
+	var timer *time.Timer
+	var fire <-chan time.Time
+
 	for {
 		select {
-		case event := <-watcher.Events:
-			for _, file := range files {
-				name := path.Base(event.Name)
-				if name == path.Base(file) {
-					logger.Printf("received fs event for %s", name)
-
-					// If we get Create event, it's probably because the file was
-					// removed and then re-added. Need to re-register for events
-					// on file or we won't get them in the future.
-					if event.Op&fsnotify.Create == fsnotify.Create {
-						watcher.Add(file)
-					}
-
-					if fileChanged(hashes, file) {
-						logger.Printf("detected change on %s", name)
-						notify <- true
-					} else {
-						logger.Printf("no change on %s", name)
-					}
-
-					break
+		case event := <-watcher.Events():
+			logger.Printf("received fs event for %s", path.Base(event.Name))
+
+			// Re-arm the watch across atomic-replace patterns. A Remove
+			// means the directory may have been swapped out from under us
+			// (Kubernetes projected volumes do this via a symlink swap on
+			// the parent directory), so re-add all roots. A Create means
+			// a file was removed and re-added, so make sure we're still
+			// watching it directly too.
+			switch {
+			case event.Op&Remove == Remove:
+				for _, root := range watchRoots(w.Files) {
+					watcher.Add(root)
+				}
+			case event.Op&Create == Create:
+				watcher.Add(event.Name)
+			}
+
+			if timer == nil {
+				timer = time.NewTimer(debounce)
+			} else {
+				if !timer.Stop() {
+					<-timer.C
 				}
+				timer.Reset(debounce)
 			}
+			fire = timer.C
 
-		case err := <-watcher.Errors:
+		case <-fire:
+			timer = nil
+			fire = nil
+			w.maybeReload("fs event")
+
+		case err := <-watcher.Errors():
 			logger.Printf("error watching file: %s", err)
 		}
 	}
 }
 
-// Watch files with a periodic timer, for filesystems that don't do
-// inotify correctly (e.g. some fuse filesystems or other custom stuff).
-func watchTimed(files []string, duration time.Duration, notify chan bool) {
-	hashes := hashFiles(files)
+// WatchTimed watches files with a periodic timer, for filesystems that
+// don't do inotify correctly (e.g. some fuse filesystems or other custom
+// stuff).
+func (w *Watcher) WatchTimed(duration time.Duration) {
 	ticker := time.Tick(duration)
 
 	for {
 		<-ticker
 		logger.Printf("running timed reload (timer fired)")
+		w.maybeReload("timer")
+	}
+}
 
-		change := false
-		for _, file := range files {
-			if fileChanged(hashes, file) {
-				logger.Printf("detected change on %s, reloading", path.Base(file))
-				change = true
+// WatchSignal watches files by waiting for a reload signal (e.g. SIGHUP)
+// instead of relying on filesystem events. More portable than inotify
+// (works on platforms/filesystems where it's unavailable or unreliable)
+// and only checks for changes when a signal arrives, not mid-write. Hashes
+// are still compared (and the file set optionally validated) before
+// signalling, so a signal with unchanged files is a no-op.
+func (w *Watcher) WatchSignal(signals []os.Signal) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, signals...)
+
+	for {
+		sig := <-sigCh
+		logger.Printf("received signal %s, checking for changes", sig)
+		w.maybeReload("signal")
+	}
+}
+
+// expandFiles resolves a list of paths, directories, and glob patterns
+// (e.g. "/etc/ghostunnel/certs/*.pem") into a flat, de-duplicated list of
+// regular files. Directories expand to their immediate children, and
+// patterns that don't match anything (e.g. a file not created yet) are
+// passed through unchanged so hashFile can report the error.
+func expandFiles(patterns []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			add(pattern)
+			continue
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				add(match)
+				continue
 			}
+
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				logger.Printf("error reading directory %s: %s", match, err)
+				continue
+			}
+
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					add(filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// watchRoots returns the set of directories fsnotify should watch to
+// observe changes to the given files, directories, and glob patterns.
+func watchRoots(patterns []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+
+	for _, pattern := range patterns {
+		root := filepath.Dir(pattern)
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			root = pattern
 		}
 
-		if change {
-			notify <- true
-		} else {
-			logger.Printf("nothing changed, not reloading")
+		if !seen[root] {
+			seen[root] = true
+			out = append(out, root)
 		}
 	}
+
+	return out
 }
 
-// Hash initial state of files we're watching
+// Hash the current state of an (already-expanded) list of files, keyed
+// by full path so that files with the same basename in different
+// directories (e.g. two certs named tls.crt under different mount
+// points) don't collide.
 func hashFiles(files []string) map[string][32]byte {
 	hashes := make(map[string][32]byte)
 
@@ -110,9 +285,8 @@ func hashFiles(files []string) map[string][32]byte {
 			continue
 		}
 
-		name := path.Base(file)
-		logger.Printf("sha256(%s) = %s", name, hex.EncodeToString(hash[:]))
-		hashes[name] = hash
+		logger.Printf("sha256(%s) = %s", path.Base(file), hex.EncodeToString(hash[:]))
+		hashes[file] = hash
 	}
 
 	return hashes
@@ -128,20 +302,19 @@ func hashFile(file string) ([32]byte, error) {
 	return sha256.Sum256(data), nil
 }
 
-// Check if a file has changed contents, update hash
-func fileChanged(hashes map[string][32]byte, file string) bool {
-	newHash, err := hashFile(file)
-	if err != nil {
-		logger.Printf("error reading file: %s", err)
-		return false
+// hashesDiffer reports whether the new hash set differs from the old one
+// -- a changed file, a new file, or one that's gone.
+func hashesDiffer(old, new map[string][32]byte) bool {
+	for name, hash := range new {
+		if oldHash, ok := old[name]; !ok || oldHash != hash {
+			return true
+		}
 	}
 
-	name := path.Base(file)
-	oldHash := hashes[name]
-	if !bytes.Equal(oldHash[:], newHash[:]) {
-		logger.Printf("sha256(%s) = %s", name, hex.EncodeToString(newHash[:]))
-		hashes[name] = newHash
-		return true
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			return true
+		}
 	}
 
 	return false
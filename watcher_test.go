@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaybeReloadValidationSuppressesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-watcher-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+
+	notify := make(chan bool, 1)
+	reject := true
+	w := NewWatcher([]string{file}, notify, func(files []string) error {
+		if reject {
+			return &ValidationError{Reason: "test_rejected", Err: errTestRejected}
+		}
+		return nil
+	})
+
+	if err := ioutil.WriteFile(file, []byte("v2-broken"), 0644); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+
+	w.maybeReload("test")
+	select {
+	case <-notify:
+		t.Fatal("expected no reload while validator rejects the new file set")
+	default:
+	}
+
+	reject = false
+	w.maybeReload("test")
+	select {
+	case <-notify:
+	default:
+		t.Fatal("expected reload once validator accepts the new file set")
+	}
+}
+
+func TestWatchAutoDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-watcher-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+
+	notify := make(chan bool, 1)
+	w := NewWatcher([]string{file}, notify, nil)
+	go w.WatchAuto(50 * time.Millisecond)
+
+	// Simulate a burst of writes within the debounce window, as happens
+	// with an atomic rename from a tempfile.
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(file, []byte("v2"), 0644); err != nil {
+			t.Fatalf("unable to write file: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-notify:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a reload notification after the debounce window")
+	}
+
+	select {
+	case <-notify:
+		t.Fatal("expected the burst of writes to coalesce into a single reload")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+var errTestRejected = &testError{"file set rejected by test validator"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }